@@ -0,0 +1,150 @@
+package gotrntmessages
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// parseExtendedHandshakeM extracts the "m" dictionary from a BEP-10
+// extended handshake payload (ExtendedMsgID == 0), mapping each
+// extension name the peer advertised to the numeric id it wants that
+// extension addressed by. It walks the payload as a real top-level
+// bencode dictionary - skipping over every other key's value,
+// whatever type it is - rather than guessing "m"'s position with a
+// substring search, since an unrelated key's value could otherwise
+// contain the same bytes.
+func parseExtendedHandshakeM(payload []byte) (map[string]uint8, bool) {
+	if len(payload) == 0 || payload[0] != 'd' {
+		return nil, false
+	}
+	buf := payload[1:]
+
+	for len(buf) > 0 && buf[0] != 'e' {
+		key, n, ok := parseBencodeString(buf)
+		if !ok {
+			return nil, false
+		}
+		buf = buf[n:]
+
+		if key == "m" {
+			return parseFlatIntDict(buf)
+		}
+
+		n, ok = skipBencodeValue(buf)
+		if !ok {
+			return nil, false
+		}
+		buf = buf[n:]
+	}
+
+	return nil, false
+}
+
+// parseFlatIntDict parses the flat bencoded dictionary of strings to
+// integers that "m" is defined to be, e.g. "d11:ut_metadatai1ee".
+func parseFlatIntDict(buf []byte) (map[string]uint8, bool) {
+	if len(buf) == 0 || buf[0] != 'd' {
+		return nil, false
+	}
+	buf = buf[1:]
+
+	m := make(map[string]uint8)
+	for len(buf) > 0 && buf[0] != 'e' {
+		key, n, ok := parseBencodeString(buf)
+		if !ok {
+			return nil, false
+		}
+		buf = buf[n:]
+
+		if len(buf) == 0 || buf[0] != 'i' {
+			return nil, false
+		}
+		end := bytes.IndexByte(buf, 'e')
+		if end < 0 {
+			return nil, false
+		}
+		val, err := strconv.Atoi(string(buf[1:end]))
+		if err != nil {
+			return nil, false
+		}
+		m[key] = uint8(val)
+		buf = buf[end+1:]
+	}
+
+	if len(buf) == 0 {
+		// Ran out of payload without finding the closing 'e'.
+		return nil, false
+	}
+	return m, true
+}
+
+// parseBencodeString parses a bencoded string ("<len>:<bytes>") off
+// the front of buf, returning the decoded string and how many bytes
+// of buf it consumed.
+func parseBencodeString(buf []byte) (string, int, bool) {
+	colon := bytes.IndexByte(buf, ':')
+	if colon < 0 {
+		return "", 0, false
+	}
+	strLen, err := strconv.Atoi(string(buf[:colon]))
+	if err != nil || strLen < 0 || colon+1+strLen > len(buf) {
+		return "", 0, false
+	}
+	return string(buf[colon+1 : colon+1+strLen]), colon + 1 + strLen, true
+}
+
+// skipBencodeValue consumes one bencode value of any type (string,
+// integer, list, or dict) off the front of buf, returning how many
+// bytes it occupied. Used to step over keys in an extended handshake
+// payload that aren't "m", whatever shape their value takes.
+func skipBencodeValue(buf []byte) (int, bool) {
+	if len(buf) == 0 {
+		return 0, false
+	}
+
+	switch buf[0] {
+	case 'i':
+		end := bytes.IndexByte(buf, 'e')
+		if end < 0 {
+			return 0, false
+		}
+		return end + 1, true
+
+	case 'l':
+		i := 1
+		for i < len(buf) && buf[i] != 'e' {
+			n, ok := skipBencodeValue(buf[i:])
+			if !ok {
+				return 0, false
+			}
+			i += n
+		}
+		if i >= len(buf) {
+			return 0, false
+		}
+		return i + 1, true
+
+	case 'd':
+		i := 1
+		for i < len(buf) && buf[i] != 'e' {
+			_, n, ok := parseBencodeString(buf[i:])
+			if !ok {
+				return 0, false
+			}
+			i += n
+			n, ok = skipBencodeValue(buf[i:])
+			if !ok {
+				return 0, false
+			}
+			i += n
+		}
+		if i >= len(buf) {
+			return 0, false
+		}
+		return i + 1, true
+
+	default:
+		_, n, ok := parseBencodeString(buf)
+		return n, ok
+	}
+}
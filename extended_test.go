@@ -0,0 +1,89 @@
+package gotrntmessages
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestParseExtendedHandshakeM exercises the realistic, multi-key
+// extended-handshake payload shape this parser actually sees on the
+// wire: other keys ("v", "p") surrounding "m", of both string and
+// integer type, including one ("v") whose value contains the literal bytes
+// "1:m" - which a substring-search parser would latch onto instead of
+// the real "m" dict.
+func TestParseExtendedHandshakeM(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload string
+		want    map[string]uint8
+		wantOk  bool
+	}{
+		{
+			name:    "m after a decoy value containing 1:m",
+			payload: "d1:v7:1:mXXXe1:md11:ut_metadatai1eee",
+			want:    map[string]uint8{"ut_metadata": 1},
+			wantOk:  true,
+		},
+		{
+			name:    "m among several sibling keys of mixed types",
+			payload: "d1:pi6881e1:md11:ut_metadatai3e6:ut_pexi1ee1:v11:libtorrente",
+			want:    map[string]uint8{"ut_metadata": 3, "ut_pex": 1},
+			wantOk:  true,
+		},
+		{
+			name:    "no m key present",
+			payload: "d1:v11:libtorrente",
+			want:    nil,
+			wantOk:  false,
+		},
+		{
+			name:    "not a dict at all",
+			payload: "i1e",
+			want:    nil,
+			wantOk:  false,
+		},
+		{
+			name:    "truncated payload",
+			payload: "d1:md11:ut_metadatai1e",
+			want:    nil,
+			wantOk:  false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := parseExtendedHandshakeM([]byte(c.payload))
+			if ok != c.wantOk {
+				t.Fatalf("ok = %v, want %v", ok, c.wantOk)
+			}
+			if ok && !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+// TestDecodeMessageExtendedHandshake checks that DecodeMessage wires
+// parseExtendedHandshakeM's result into ExtendedHandshakeM for a real
+// ExtendedMsgID == 0 extended handshake message - the path
+// TestEncodeDecodeRoundTrip never exercises, since it only ever builds
+// MsgDataExtended with ExtendedMsgID in 1..255.
+func TestDecodeMessageExtendedHandshake(t *testing.T) {
+	payload := "d1:md11:ut_metadatai1e6:ut_pexi2eee"
+	buf := []byte{0, 0, 0, 0, 20, 0}
+	buf[3] = byte(2 + len(payload))
+	buf = append(buf, []byte(payload)...)
+
+	msgData, ok := DecodeMessage(buf)
+	if !ok {
+		t.Fatalf("DecodeMessage: ok = false")
+	}
+	msgExt, isExt := msgData.(MsgDataExtended)
+	if !isExt {
+		t.Fatalf("DecodeMessage returned %T, want MsgDataExtended", msgData)
+	}
+	want := map[string]uint8{"ut_metadata": 1, "ut_pex": 2}
+	if !reflect.DeepEqual(msgExt.ExtendedHandshakeM, want) {
+		t.Fatalf("ExtendedHandshakeM = %v, want %v", msgExt.ExtendedHandshakeM, want)
+	}
+}
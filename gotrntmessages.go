@@ -8,38 +8,57 @@ import (
 var goTrntHeader string = "BitTorrent protocol"
 var goTrntHeaderLen byte = byte(len(goTrntHeader))
 
-// Message types
+// Message types. Values for real peer wire messages match their
+// on-the-wire id exactly, so they can be used directly as the <id>
+// byte; synthetic types with no wire id of their own (Handshake,
+// KeepAlive, Invalid) are given values outside the single-byte range
+// so they can never collide with one.
 const (
-	MsgTypeChoke = iota
-	MsgTypeUnchoke
-	MsgTypeInterested
-	MsgTypeNotInterested
-	MsgTypeHave
-	MsgTypeBitfield
-	MsgTypeRequest
-	MsgTypePiece
-	MsgTypeCancel
-	MsgTypePort
-	MsgTypeHandshake
-	MsgTypeKeepAlive
-	MsgTypeInvalid
+	MsgTypeChoke         = 0
+	MsgTypeUnchoke       = 1
+	MsgTypeInterested    = 2
+	MsgTypeNotInterested = 3
+	MsgTypeHave          = 4
+	MsgTypeBitfield      = 5
+	MsgTypeRequest       = 6
+	MsgTypePiece         = 7
+	MsgTypeCancel        = 8
+	MsgTypePort          = 9
+	MsgTypeSuggestPiece  = 13
+	MsgTypeHaveAll       = 14
+	MsgTypeHaveNone      = 15
+	MsgTypeRejectRequest = 16
+	MsgTypeAllowedFast   = 17
+	MsgTypeExtended      = 20
+
+	MsgTypeHandshake = 1000
+	MsgTypeKeepAlive = 1001
+	MsgTypeInvalid   = 1002
 )
 
-// Message type names
-var MsgTypeNames []string = []string{
-	"Choke",
-	"Unchoke",
-	"Interested",
-	"NotInterested",
-	"Have",
-	"Bitfiled",
-	"Request",
-	"Piece",
-	"Cancel",
-	"Port",
-	"Handshake",
-	"KeepAlive",
-	"Invalid"}
+// Message type names, keyed by MsgType rather than indexed, since the
+// values above aren't contiguous.
+var MsgTypeNames map[uint]string = map[uint]string{
+	MsgTypeChoke:         "Choke",
+	MsgTypeUnchoke:       "Unchoke",
+	MsgTypeInterested:    "Interested",
+	MsgTypeNotInterested: "NotInterested",
+	MsgTypeHave:          "Have",
+	MsgTypeBitfield:      "Bitfiled",
+	MsgTypeRequest:       "Request",
+	MsgTypePiece:         "Piece",
+	MsgTypeCancel:        "Cancel",
+	MsgTypePort:          "Port",
+	MsgTypeSuggestPiece:  "SuggestPiece",
+	MsgTypeHaveAll:       "HaveAll",
+	MsgTypeHaveNone:      "HaveNone",
+	MsgTypeRejectRequest: "RejectRequest",
+	MsgTypeAllowedFast:   "AllowedFast",
+	MsgTypeExtended:      "Extended",
+	MsgTypeHandshake:     "Handshake",
+	MsgTypeKeepAlive:     "KeepAlive",
+	MsgTypeInvalid:       "Invalid",
+}
 
 // Generic interface used to handle messages
 type MsgData interface {
@@ -106,6 +125,95 @@ type MsgDataHandshake struct {
 	PeerId         string
 }
 
+// Reserved byte/bit pairs used to negotiate protocol extensions in a
+// handshake's 8 reserved bytes. Byte 5, bit 0x10 is BEP-10 (LTEP);
+// byte 7, bits 0x01 and 0x04 are BEP-5 (DHT) and BEP-6 (Fast
+// Extension) respectively.
+const (
+	reservedByteLTEP = 5
+	reservedBitLTEP  = 0x10
+	reservedByteDHT  = 7
+	reservedBitDHT   = 0x01
+	reservedByteFast = 7
+	reservedBitFast  = 0x04
+)
+
+// SupportsLTEP reports whether the peer advertised the BEP-10
+// Extension Protocol in its handshake reserved bytes.
+func (msgHs MsgDataHandshake) SupportsLTEP() bool {
+	return msgHs.reservedBitSet(reservedByteLTEP, reservedBitLTEP)
+}
+
+// SupportsDHT reports whether the peer advertised BEP-5 DHT support
+// in its handshake reserved bytes.
+func (msgHs MsgDataHandshake) SupportsDHT() bool {
+	return msgHs.reservedBitSet(reservedByteDHT, reservedBitDHT)
+}
+
+// SupportsFast reports whether the peer advertised the BEP-6 Fast
+// Extension in its handshake reserved bytes.
+func (msgHs MsgDataHandshake) SupportsFast() bool {
+	return msgHs.reservedBitSet(reservedByteFast, reservedBitFast)
+}
+
+func (msgHs MsgDataHandshake) reservedBitSet(byteIdx int, bit byte) bool {
+	if len(msgHs.ReservedBytes) <= byteIdx {
+		return false
+	}
+	return msgHs.ReservedBytes[byteIdx]&bit != 0
+}
+
+// SetLTEP sets or clears the BEP-10 Extension Protocol reserved bit,
+// so callers building a handshake don't have to hand-construct the
+// reserved bytes themselves.
+func (msgHs *MsgDataHandshake) SetLTEP(enabled bool) {
+	msgHs.setReservedBit(reservedByteLTEP, reservedBitLTEP, enabled)
+}
+
+// SetFast sets or clears the BEP-6 Fast Extension reserved bit, so
+// callers building a handshake don't have to hand-construct the
+// reserved bytes themselves.
+func (msgHs *MsgDataHandshake) SetFast(enabled bool) {
+	msgHs.setReservedBit(reservedByteFast, reservedBitFast, enabled)
+}
+
+func (msgHs *MsgDataHandshake) setReservedBit(byteIdx int, bit byte, enabled bool) {
+	reserved := make([]byte, 8)
+	copy(reserved, msgHs.ReservedBytes)
+	if enabled {
+		reserved[byteIdx] |= bit
+	} else {
+		reserved[byteIdx] &^= bit
+	}
+	msgHs.ReservedBytes = string(reserved)
+}
+
+// Suggest Piece and Allowed Fast messages (BEP-6)
+type MsgDataPieceIndex struct {
+	MsgDataCommon
+	PieceIndex uint32
+}
+
+// Have All and Have None messages (BEP-6)
+type MsgDataHaveAllNone struct {
+	MsgDataCommon
+	HasAll bool
+}
+
+// Extended message (BEP-10)
+type MsgDataExtended struct {
+	MsgDataCommon
+	ExtendedMsgID uint8
+	Payload       []byte
+
+	// ExtendedHandshakeM holds the negotiated "m" dictionary from an
+	// extended handshake (ExtendedMsgID == 0), mapping extension
+	// names (e.g. "ut_metadata", "ut_pex") to the numeric ids the
+	// peer wants them addressed by. Nil for non-handshake extended
+	// messages, or if the payload couldn't be parsed.
+	ExtendedHandshakeM map[string]uint8
+}
+
 // Port message
 type MsgDataPort struct {
 	MsgDataCommon
@@ -124,7 +232,7 @@ func GetMessageType(buf []byte) (uint, string) {
 		// BitTorrent messages are of format <len><id><payload>,
 		// where <len> is of four bytes.
 		msgType := uint(buf[4])
-		if msgType > MsgTypeInvalid {
+		if _, known := MsgTypeNames[msgType]; !known {
 			msgType = MsgTypeInvalid
 		}
 		return msgType, MsgTypeNames[msgType]
@@ -133,17 +241,26 @@ func GetMessageType(buf []byte) (uint, string) {
 }
 
 // Decode raw buffer received from peer into our structs
-func DecodeMessage(buf []byte) (MsgData, bool) {
+func DecodeMessage(buf []byte) (msgData MsgData, ok bool) {
+	origBuf := buf
+	msgType, _ := GetMessageType(buf)
+	defer func() {
+		if ok {
+			currentMetrics().ObserveMessage(msgType, "decode", len(origBuf))
+		} else {
+			currentMetrics().ObserveDecodeError(classifyDecodeFailure(origBuf, msgType))
+		}
+	}()
+
 	// Sanity checks
 	if len(buf) <= 0 {
 		return nil, false
 	}
 
-	// Get message type from buffer
-	msgType, _ := GetMessageType(buf)
-
-	// Remove <len> prefix from buffer, as we no longer need it.
-	if msgType >= MsgTypeChoke && msgType <= MsgTypePort {
+	// Remove <len> prefix from buffer, as we no longer need it. Every
+	// real wire message carries one; only the synthetic Handshake,
+	// KeepAlive and Invalid types don't.
+	if msgType != MsgTypeHandshake && msgType != MsgTypeKeepAlive && msgType != MsgTypeInvalid {
 		buf = buf[4:]
 	}
 
@@ -172,6 +289,9 @@ func DecodeMessage(buf []byte) (MsgData, bool) {
 
 	case MsgTypeHave:
 		// <id=4><piece index>
+		if len(buf) < 5 {
+			return nil, false
+		}
 		var msgData MsgDataHave
 		msgData.MsgType = msgType
 		msgData.PieceIndex = getUint32FromBytes(buf[1:5])
@@ -179,6 +299,9 @@ func DecodeMessage(buf []byte) (MsgData, bool) {
 
 	case MsgTypeBitfield:
 		// <id=5><bitfield>
+		if len(buf) < 1 {
+			return nil, false
+		}
 		var msgData MsgDataBitfield
 		msgData.MsgType = msgType
 		msgData.Bitfield = buf[1:]
@@ -186,6 +309,9 @@ func DecodeMessage(buf []byte) (MsgData, bool) {
 
 	case MsgTypePiece:
 		// <id=7><index><begin><block>
+		if len(buf) < 9 {
+			return nil, false
+		}
 		var msgData MsgDataPiece
 		msgData.MsgType = msgType
 		msgData.PieceIndex = getUint32FromBytes(buf[1:5])
@@ -195,6 +321,9 @@ func DecodeMessage(buf []byte) (MsgData, bool) {
 
 	case MsgTypeRequest, MsgTypeCancel:
 		// <id=6/8><index><begin><length>
+		if len(buf) < 13 {
+			return nil, false
+		}
 		var msgData MsgDataRequestCancel
 		msgData.MsgType = msgType
 		msgData.PieceIndex = getUint32FromBytes(buf[1:5])
@@ -204,13 +333,62 @@ func DecodeMessage(buf []byte) (MsgData, bool) {
 
 	case MsgTypePort:
 		// <id=9><listen-port>
+		if len(buf) < 3 {
+			return nil, false
+		}
 		var msgData MsgDataPort
 		msgData.MsgType = msgType
 		msgData.PeerPort = getUint16FromBytes(buf[1:3])
 		return msgData, true
 
+	case MsgTypeSuggestPiece, MsgTypeAllowedFast:
+		// <id=13/17><piece index>
+		if len(buf) < 5 {
+			return nil, false
+		}
+		var msgData MsgDataPieceIndex
+		msgData.MsgType = msgType
+		msgData.PieceIndex = getUint32FromBytes(buf[1:5])
+		return msgData, true
+
+	case MsgTypeHaveAll, MsgTypeHaveNone:
+		// <id=14/15>
+		var msgData MsgDataHaveAllNone
+		msgData.MsgType = msgType
+		msgData.HasAll = msgType == MsgTypeHaveAll
+		return msgData, true
+
+	case MsgTypeRejectRequest:
+		// <id=16><index><begin><length>
+		if len(buf) < 13 {
+			return nil, false
+		}
+		var msgData MsgDataRequestCancel
+		msgData.MsgType = msgType
+		msgData.PieceIndex = getUint32FromBytes(buf[1:5])
+		msgData.PieceBytesBegin = getUint32FromBytes(buf[5:9])
+		msgData.PieceBytesLen = getUint32FromBytes(buf[9:13])
+		return msgData, true
+
+	case MsgTypeExtended:
+		// <id=20><extended-id><payload>
+		if len(buf) < 2 {
+			return nil, false
+		}
+		var msgData MsgDataExtended
+		msgData.MsgType = msgType
+		msgData.ExtendedMsgID = buf[1]
+		msgData.Payload = buf[2:]
+		if msgData.ExtendedMsgID == 0 {
+			msgData.ExtendedHandshakeM, _ = parseExtendedHandshakeM(msgData.Payload)
+		}
+		return msgData, true
+
 	case MsgTypeHandshake:
 		// <pstrlen><pstr><reserved><info_hash><peer_id>
+		if len(buf) < 68 {
+			return nil, false
+		}
 		var msgData MsgDataHandshake
 		msgData.MsgType = msgType
 		msgData.ProtocolStrLen = int(buf[0])
@@ -229,7 +407,13 @@ func DecodeMessage(buf []byte) (MsgData, bool) {
 
 // Build raw message buffer to send to a peer
 // Message format: <length prefix><message ID><payload>
-func EncodeMessage(msgType uint, msgData MsgData) ([]byte, bool) {
+func EncodeMessage(msgType uint, msgData MsgData) (encoded []byte, ok bool) {
+	defer func() {
+		if ok {
+			currentMetrics().ObserveMessage(msgType, "encode", len(encoded))
+		}
+	}()
+
 	buf := new(bytes.Buffer)
 
 	switch msgType {
@@ -238,6 +422,12 @@ func EncodeMessage(msgType uint, msgData MsgData) ([]byte, bool) {
 		buf.Write(getBytesFromUint32(1)) // len
 		buf.WriteByte(byte(msgType))     // id
 		return buf.Bytes(), true
+
+	case MsgTypeHaveAll, MsgTypeHaveNone:
+		// <len=0001><id=14/15>
+		buf.Write(getBytesFromUint32(1)) // len
+		buf.WriteByte(byte(msgType))     // id
+		return buf.Bytes(), true
 	}
 
 	// Sanity checks
@@ -306,19 +496,53 @@ func EncodeMessage(msgType uint, msgData MsgData) ([]byte, bool) {
 		buf.WriteByte(byte(9))                          // id
 		buf.Write(getBytesFromUint16(msgPort.PeerPort)) // listen-port
 
+	case MsgTypeSuggestPiece, MsgTypeAllowedFast:
+		// <len=0005><id=13/17><piece index>
+		msgPieceIdx, ok := msgData.(MsgDataPieceIndex)
+		if !ok {
+			return buf.Bytes(), false
+		}
+		buf.Write(getBytesFromUint32(5))                      // len
+		buf.WriteByte(byte(msgType))                          // id
+		buf.Write(getBytesFromUint32(msgPieceIdx.PieceIndex)) // piece index
+
+	case MsgTypeRejectRequest:
+		// <len=0013><id=16><index><begin><length>
+		msgReject, ok := msgData.(MsgDataRequestCancel)
+		if !ok {
+			return buf.Bytes(), false
+		}
+		buf.Write(getBytesFromUint32(13))                        // len
+		buf.WriteByte(byte(msgType))                             // id
+		buf.Write(getBytesFromUint32(msgReject.PieceIndex))      // piece index
+		buf.Write(getBytesFromUint32(msgReject.PieceBytesBegin)) // piece begin
+		buf.Write(getBytesFromUint32(msgReject.PieceBytesLen))   // piece len
+
+	case MsgTypeExtended:
+		// <len=0002+X><id=20><extended-id><payload>
+		msgExt, ok := msgData.(MsgDataExtended)
+		if !ok {
+			return buf.Bytes(), false
+		}
+		msgLen := uint32(2 + len(msgExt.Payload))
+		buf.Write(getBytesFromUint32(msgLen)) // len
+		buf.WriteByte(20)                     // id
+		buf.WriteByte(msgExt.ExtendedMsgID)   // extended-id
+		buf.Write(msgExt.Payload)             // payload
+
 	case MsgTypeHandshake:
 		// <pstrlen><pstr><reserved><info_hash><peer_id>
 		msgHs, ok := msgData.(MsgDataHandshake)
 		if !ok {
 			return buf.Bytes(), false
 		}
-		buf.WriteByte(goTrntHeaderLen) // pstrlen
-		buf.WriteString(goTrntHeader)  // pstr
-		for i := 0; i < 8; i++ {       // reserved
-			buf.WriteByte(0)
-		}
-		buf.WriteString(msgHs.InfoHash) // info hash
-		buf.WriteString(msgHs.PeerId)   // my id
+		var reserved [8]byte
+		copy(reserved[:], msgHs.ReservedBytes) // defaults to all-zero if unset
+		buf.WriteByte(goTrntHeaderLen)         // pstrlen
+		buf.WriteString(goTrntHeader)          // pstr
+		buf.Write(reserved[:])                 // reserved
+		buf.WriteString(msgHs.InfoHash)        // info hash
+		buf.WriteString(msgHs.PeerId)          // my id
 
 	case MsgTypeKeepAlive:
 		// <len=0000>
@@ -342,8 +566,8 @@ func getBytesFromUint32(num uint32) []byte {
 
 func getBytesFromUint16(num uint16) []byte {
 	var buf [2]byte
-	buf[0] = byte((num >> 8) | 0xff)
-	buf[1] = byte(num | 0xff)
+	buf[0] = byte((num >> 8) & 0xff)
+	buf[1] = byte(num & 0xff)
 	return buf[0:]
 }
 
@@ -0,0 +1,71 @@
+package gotrntmessages
+
+import "sync/atomic"
+
+// Metrics receives observations from the encode/decode paths, so a
+// caller can expose per-peer-message-type throughput and error rates
+// without instrumenting every call site itself.
+type Metrics interface {
+	// ObserveMessage records one successfully encoded or decoded
+	// message: its type, direction ("encode" or "decode"), and wire
+	// size in bytes.
+	ObserveMessage(msgType uint, direction string, bytes int)
+
+	// ObserveDecodeError records a failed DecodeMessage call, tagged
+	// with a short, stable reason such as "short_buffer",
+	// "unknown_id", or "handshake_mismatch".
+	ObserveDecodeError(reason string)
+}
+
+// noopMetrics is the default Metrics: zero cost when no caller has
+// registered one of their own.
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveMessage(msgType uint, direction string, bytes int) {}
+func (noopMetrics) ObserveDecodeError(reason string)                         {}
+
+// metricsBox wraps a Metrics so atomic.Value always sees the same
+// concrete type across Store calls, regardless of what implementation
+// callers register.
+type metricsBox struct {
+	m Metrics
+}
+
+var activeMetrics atomic.Value // holds metricsBox
+
+func init() {
+	activeMetrics.Store(metricsBox{noopMetrics{}})
+}
+
+// SetMetrics registers m to receive encode/decode observations. A nil
+// m restores the no-op default. Safe to call concurrently with
+// EncodeMessage/DecodeMessage from any number of goroutines.
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = noopMetrics{}
+	}
+	activeMetrics.Store(metricsBox{m})
+}
+
+// currentMetrics returns the Metrics currently registered via
+// SetMetrics, or noopMetrics if none has been.
+func currentMetrics() Metrics {
+	return activeMetrics.Load().(metricsBox).m
+}
+
+// classifyDecodeFailure returns a short, stable reason for a failed
+// DecodeMessage call, for use as a metrics label.
+func classifyDecodeFailure(buf []byte, msgType uint) string {
+	if len(buf) <= 0 {
+		return "short_buffer"
+	}
+	if buf[0] == goTrntHeaderLen && msgType != MsgTypeHandshake {
+		// Looked like a handshake attempt (pstrlen byte matches ours)
+		// but the protocol string or framing didn't.
+		return "handshake_mismatch"
+	}
+	if msgType == MsgTypeInvalid {
+		return "unknown_id"
+	}
+	return "short_buffer"
+}
@@ -0,0 +1,70 @@
+// Package promexport adapts gotrntmessages.Metrics onto Prometheus
+// client_golang collectors, so a caller can get per-peer-message-type
+// throughput and decode-error rates just by registering it.
+package promexport
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/swatkat/gotrntmessages"
+)
+
+// Metrics is a gotrntmessages.Metrics backed by Prometheus collectors.
+type Metrics struct {
+	messages   *prometheus.CounterVec
+	bytes      *prometheus.HistogramVec
+	decodeErrs *prometheus.CounterVec
+}
+
+// New creates a Metrics and registers its collectors with reg.
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gotrntmessages",
+			Name:      "messages_total",
+			Help:      "Total number of peer-wire messages encoded or decoded, by message type and direction.",
+		}, []string{"msg_type", "direction"}),
+		bytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "gotrntmessages",
+			Name:      "message_bytes",
+			Help:      "Size in bytes of peer-wire messages encoded or decoded, by message type and direction.",
+			Buckets:   prometheus.ExponentialBuckets(8, 2, 16),
+		}, []string{"msg_type", "direction"}),
+		decodeErrs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gotrntmessages",
+			Name:      "decode_errors_total",
+			Help:      "Total number of DecodeMessage failures, by reason.",
+		}, []string{"reason"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.messages, m.bytes, m.decodeErrs} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ObserveMessage implements gotrntmessages.Metrics.
+func (m *Metrics) ObserveMessage(msgType uint, direction string, bytes int) {
+	label := msgTypeLabel(msgType)
+	m.messages.WithLabelValues(label, direction).Inc()
+	m.bytes.WithLabelValues(label, direction).Observe(float64(bytes))
+}
+
+// ObserveDecodeError implements gotrntmessages.Metrics.
+func (m *Metrics) ObserveDecodeError(reason string) {
+	m.decodeErrs.WithLabelValues(reason).Inc()
+}
+
+// msgTypeLabel renders msgType as its name from gotrntmessages.MsgTypeNames,
+// falling back to its numeric value for unrecognized types.
+func msgTypeLabel(msgType uint) string {
+	if name, ok := gotrntmessages.MsgTypeNames[msgType]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(msgType), 10)
+}
+
+var _ gotrntmessages.Metrics = (*Metrics)(nil)
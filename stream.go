@@ -0,0 +1,126 @@
+package gotrntmessages
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrInvalidMessage is returned by the streaming codec when a message
+// cannot be decoded or encoded against the peer wire protocol.
+var ErrInvalidMessage = errors.New("gotrntmessages: invalid message")
+
+// ErrMessageTooLarge is returned by Decoder.Next when a peer's length
+// prefix exceeds maxMessageLen, rather than trusting it and allocating
+// a buffer of whatever size an untrusted peer asks for.
+var ErrMessageTooLarge = errors.New("gotrntmessages: message exceeds maximum length")
+
+// maxMessageLen is the largest message body Next will allocate for.
+// The biggest legitimate peer wire message is a Piece carrying a
+// single block, which in practice is never more than a few hundred KB;
+// 1<<20 leaves generous headroom above that without letting a peer's
+// length prefix force a multi-gigabyte allocation.
+const maxMessageLen = 1 << 20
+
+// KeepAlive message. Unlike every other message it carries no id byte,
+// just a zero length prefix, so it has no dedicated wire id of its own.
+type MsgDataKeepAlive struct {
+	MsgDataCommon
+}
+
+// Decoder reads length-prefixed peer wire protocol messages off a
+// stream, e.g. a net.Conn to a peer. Handshakes use their own framing
+// and are read separately with NextHandshake.
+type Decoder struct {
+	r io.Reader
+}
+
+// NewDecoder returns a Decoder that reads messages from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Next reads and decodes the next <len><id><payload> message from the
+// stream, blocking until a full message has arrived. A zero length
+// prefix is reported as MsgDataKeepAlive rather than an error.
+func (dec *Decoder) Next() (MsgData, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(dec.r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	msgLen := binary.BigEndian.Uint32(lenBuf[:])
+	if msgLen == 0 {
+		return MsgDataKeepAlive{MsgDataCommon{MsgTypeKeepAlive}}, nil
+	}
+	if msgLen > maxMessageLen {
+		return nil, ErrMessageTooLarge
+	}
+
+	body := make([]byte, msgLen)
+	if _, err := io.ReadFull(dec.r, body); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, len(lenBuf)+len(body))
+	buf = append(buf, lenBuf[:]...)
+	buf = append(buf, body...)
+
+	msgData, ok := DecodeMessage(buf)
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+	return msgData, nil
+}
+
+// NextHandshake reads a handshake message. Handshakes aren't framed
+// with a <len> prefix like the rest of the protocol; instead they're
+// <pstrlen><pstr><reserved><info_hash><peer_id>, so the pstrlen byte
+// tells us how many more bytes to read.
+func (dec *Decoder) NextHandshake() (MsgDataHandshake, error) {
+	var pstrlenBuf [1]byte
+	if _, err := io.ReadFull(dec.r, pstrlenBuf[:]); err != nil {
+		return MsgDataHandshake{}, err
+	}
+
+	rest := make([]byte, int(pstrlenBuf[0])+48)
+	if _, err := io.ReadFull(dec.r, rest); err != nil {
+		return MsgDataHandshake{}, err
+	}
+
+	buf := append(pstrlenBuf[:], rest...)
+	msgData, ok := DecodeMessage(buf)
+	if !ok {
+		return MsgDataHandshake{}, ErrInvalidMessage
+	}
+	msgHs, isHs := msgData.(MsgDataHandshake)
+	if !isHs {
+		return MsgDataHandshake{}, ErrInvalidMessage
+	}
+	return msgHs, nil
+}
+
+// Encoder writes peer wire protocol messages to a stream, e.g. a
+// net.Conn to a peer.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an Encoder that writes messages to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Write encodes msgData and writes it to the underlying stream,
+// including handshakes, which carry their own framing.
+func (enc *Encoder) Write(msgData MsgData) error {
+	msgType, _ := msgData.GetMsgType()
+
+	buf, ok := EncodeMessage(msgType, msgData)
+	if !ok {
+		return ErrInvalidMessage
+	}
+
+	_, err := enc.w.Write(buf)
+	return err
+}
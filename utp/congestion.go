@@ -0,0 +1,127 @@
+package utp
+
+import "time"
+
+// LEDBAT tuning constants from BEP-29.
+const (
+	target                       = 100 * time.Millisecond
+	maxCwndIncreasePacketsPerRTT = 3000
+	minWindowSize                = 150
+	baseDelayWindow              = 2 * time.Minute
+	baseDelayBucket              = 1 * time.Minute
+)
+
+// ledbat implements the LEDBAT (Low Extra Delay Background Transport)
+// congestion controller used by uTP. It tracks the minimum one-way
+// delay observed to the peer (base_delay) over a rolling window of
+// per-minute minima, and shrinks or grows the congestion window so
+// queuing delay relative to that baseline stays near target.
+type ledbat struct {
+	cwnd       float64 // congestion window, in bytes
+	baseDelays []time.Duration
+	bucketTime time.Time
+
+	rttSmoothed time.Duration
+	rttVar      time.Duration
+}
+
+// newLedbat returns a controller with an initial window of
+// minWindowSize bytes, as BEP-29 recommends for a new connection.
+func newLedbat() *ledbat {
+	return &ledbat{cwnd: minWindowSize}
+}
+
+// updateBaseDelay folds a newly observed one-way delay sample into the
+// rolling per-minute minima used to estimate base_delay.
+func (l *ledbat) updateBaseDelay(delay time.Duration, now time.Time) {
+	if len(l.baseDelays) == 0 || now.Sub(l.bucketTime) >= baseDelayBucket {
+		l.baseDelays = append(l.baseDelays, delay)
+		l.bucketTime = now
+	} else if delay < l.baseDelays[len(l.baseDelays)-1] {
+		l.baseDelays[len(l.baseDelays)-1] = delay
+	}
+
+	// Drop minima older than the rolling window.
+	maxBuckets := int(baseDelayWindow / baseDelayBucket)
+	if len(l.baseDelays) > maxBuckets {
+		l.baseDelays = l.baseDelays[len(l.baseDelays)-maxBuckets:]
+	}
+}
+
+// baseDelay is the minimum one-way delay observed over the rolling
+// window, i.e. our best estimate of the delay with an empty queue.
+func (l *ledbat) baseDelay() time.Duration {
+	min := l.baseDelays[0]
+	for _, d := range l.baseDelays[1:] {
+		if d < min {
+			min = d
+		}
+	}
+	return min
+}
+
+// onAck adjusts cwnd for newly acked bytes, given the one-way delay
+// sample carried by that ack. Follows BEP-29's cwnd update formula:
+//
+//	off_target = (TARGET - queuing_delay) / TARGET
+//	cwnd += MAX_CWND_INCREASE_PACKETS_PER_RTT * off_target * bytesNewlyAcked / cwnd
+func (l *ledbat) onAck(delaySample time.Duration, bytesNewlyAcked int, now time.Time) {
+	if len(l.baseDelays) == 0 {
+		l.updateBaseDelay(delaySample, now)
+		return
+	}
+	l.updateBaseDelay(delaySample, now)
+
+	queuingDelay := delaySample - l.baseDelay()
+	if queuingDelay < 0 {
+		queuingDelay = 0
+	}
+
+	offTarget := (float64(target) - float64(queuingDelay)) / float64(target)
+	l.cwnd += maxCwndIncreasePacketsPerRTT * offTarget * float64(bytesNewlyAcked) / l.cwnd
+	if l.cwnd < minWindowSize {
+		l.cwnd = minWindowSize
+	}
+}
+
+// onDataLoss halves cwnd, as BEP-29 requires on a retransmit timeout
+// or triple-duplicate-ack based loss signal.
+func (l *ledbat) onDataLoss() {
+	l.cwnd /= 2
+	if l.cwnd < minWindowSize {
+		l.cwnd = minWindowSize
+	}
+}
+
+// window returns the current congestion window, in bytes.
+func (l *ledbat) window() int {
+	return int(l.cwnd)
+}
+
+// updateRTT folds a round-trip sample into the smoothed RTT and RTT
+// variance estimators, Jacobson/Karels style (same as TCP's), and
+// returns the resulting retransmit timeout.
+func (l *ledbat) updateRTT(sample time.Duration) time.Duration {
+	const (
+		alpha = 8 // 1/alpha = 0.125
+		beta  = 4 // 1/beta  = 0.25
+	)
+
+	if l.rttSmoothed == 0 {
+		l.rttSmoothed = sample
+		l.rttVar = sample / 2
+	} else {
+		delta := l.rttSmoothed - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		l.rttVar += (delta - l.rttVar) / beta
+		l.rttSmoothed += (sample - l.rttSmoothed) / alpha
+	}
+
+	rto := l.rttSmoothed + 4*l.rttVar
+	if rto < 500*time.Millisecond {
+		rto = 500 * time.Millisecond
+	}
+	return rto
+}
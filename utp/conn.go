@@ -0,0 +1,617 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// recvWindow is the receive window we advertise to peers, in bytes.
+const recvWindow = 1 << 20
+
+// initialPeerWndSize is what we assume the peer's receive window is
+// before it has told us otherwise (e.g. before the first STATE packet
+// arrives): generous enough that the congestion window, not a guess at
+// the peer's buffer, is what paces the first packets we send.
+const initialPeerWndSize = 1 << 20
+
+// maxDupAcks is how many duplicate STATE acks we tolerate before
+// treating the oldest unacked packet as lost and retransmitting it,
+// rather than waiting out a full RTO.
+const maxDupAcks = 3
+
+var (
+	// ErrClosed is returned by Read/Write after the connection has
+	// been closed.
+	ErrClosed = errors.New("utp: connection closed")
+	// ErrReset is returned when the peer sent an ST_RESET packet.
+	ErrReset = errors.New("utp: connection reset by peer")
+)
+
+type outPacket struct {
+	seqNr  uint16
+	data   []byte
+	sentAt time.Time
+	acked  bool
+}
+
+// Conn is a uTP stream connection. It implements net.Conn.
+type Conn struct {
+	pc         net.PacketConn
+	remoteAddr net.Addr
+	owned      bool // true if Conn owns pc and must Close it
+
+	connIDRecv uint16
+	connIDSend uint16
+
+	cc  *ledbat
+	rto time.Duration
+
+	mu          sync.Mutex
+	seqNr       uint16 // next sequence number we'll send
+	ackNr       uint16 // last in-order sequence number received
+	sendQueue   []*outPacket
+	dupAcks     int
+	peerWndSize uint32 // last wndSize the peer advertised to us, in bytes
+
+	// replyMicro is our current one-way delay report to the peer: how
+	// long it took their most recently received packet to reach us,
+	// by our clock. We stamp it into timestampDiff on every packet we
+	// send, so they can feed it to their own LEDBAT as a delay sample
+	// for the direction they're sending in - the whole point of uTP's
+	// timestamp exchange being symmetric per BEP-29.
+	replyMicro uint32
+
+	recvBuf  map[uint16][]byte // out-of-order data, keyed by seqNr
+	readBuf  []byte            // in-order data ready for Read
+	readCond *sync.Cond
+
+	closed     bool
+	peerClosed bool
+	resetRecvd bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer // wakes readCond waiters once readDeadline passes
+	writeTimer    *time.Timer // wakes readCond waiters once writeDeadline passes
+
+	rtoTimer *time.Timer // fires retransmitOldest if the oldest unacked packet isn't acked within rto
+
+	synAcked chan struct{} // closed once the SYN handshake completes
+
+	// onClose, if set, is called once teardown runs, so a Listener
+	// multiplexing this Conn's packets can remove it from its conns
+	// map instead of holding onto it for the rest of the process.
+	onClose func()
+}
+
+func newConn(pc net.PacketConn, remoteAddr net.Addr, connIDRecv, connIDSend uint16, owned bool) *Conn {
+	c := &Conn{
+		pc:          pc,
+		remoteAddr:  remoteAddr,
+		owned:       owned,
+		connIDRecv:  connIDRecv,
+		connIDSend:  connIDSend,
+		cc:          newLedbat(),
+		rto:         time.Second,
+		recvBuf:     make(map[uint16][]byte),
+		synAcked:    make(chan struct{}),
+		peerWndSize: initialPeerWndSize,
+	}
+	c.readCond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Dial opens a uTP connection to addr over a PacketConn the package
+// creates and owns for the lifetime of the connection.
+func Dial(network, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	return DialPacketConn(pc, raddr, true)
+}
+
+// DialPacketConn opens a uTP connection to raddr over a PacketConn of
+// the caller's own, spawning a dedicated goroutine that becomes that
+// PacketConn's sole reader for the lifetime of the connection. Because
+// of that, pc must not be a socket anything else is also reading from
+// - in particular, never pass a Listener's PacketConn here, since the
+// Listener's own readLoop would end up racing this one for the same
+// datagrams and inbound packets for either side could be silently
+// dropped. To dial out while also accepting on the same socket, use
+// (*Listener).Dial instead, which shares the Listener's demultiplexing
+// goroutine rather than starting a second one.
+// If owned is true, Close will also close pc.
+func DialPacketConn(pc net.PacketConn, raddr net.Addr, owned bool) (net.Conn, error) {
+	connIDRecv := randConnID()
+	c := newConn(pc, raddr, connIDRecv, connIDRecv+1, owned)
+	go c.readLoop()
+	return dialHandshake(c, raddr)
+}
+
+// dialHandshake sends the SYN that opens c and waits for the peer's
+// SYN-ACK, tearing c down on failure. c's packets must already be
+// reaching dispatch, whether via c's own readLoop (DialPacketConn) or
+// a Listener's shared one ((*Listener).Dial).
+func dialHandshake(c *Conn, raddr net.Addr) (net.Conn, error) {
+	syn := header{
+		typ:       stSyn,
+		ver:       protocolVersion,
+		connID:    c.connIDRecv,
+		seqNr:     1,
+		timestamp: nowMicros(),
+	}
+	c.mu.Lock()
+	c.seqNr = 2
+	c.mu.Unlock()
+	if _, err := c.pc.WriteTo(syn.encode(), raddr); err != nil {
+		c.teardown()
+		return nil, err
+	}
+
+	select {
+	case <-c.synAcked:
+		return c, nil
+	case <-time.After(c.rto):
+		c.teardown()
+		return nil, errors.New("utp: handshake timed out")
+	}
+}
+
+// readLoop is the sole reader of pc for a Dial'd connection; it keeps
+// pulling packets off the wire and handing them to dispatch until the
+// socket is closed.
+func (c *Conn) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if addr.String() != c.remoteAddr.String() {
+			continue
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		c.dispatch(pkt)
+	}
+}
+
+// dispatch processes one received packet: folding data into the
+// receive buffer, acking it, and handling control packets.
+func (c *Conn) dispatch(raw []byte) {
+	h, err := decodeHeader(raw)
+	if err != nil {
+		return
+	}
+	payload := raw[headerLen:]
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Every packet type carries the sender's current receive window;
+	// track it so Write can cap in-flight bytes at what the peer can
+	// actually buffer, not just what our congestion window allows.
+	c.peerWndSize = h.wndSize
+
+	// Record how long this packet took to reach us, by our clock, so
+	// we can report it back to the peer as their timestampDiff on our
+	// next outgoing packet - the one-way delay sample their LEDBAT
+	// needs to tell whether packets it's sending us are queuing up.
+	c.replyMicro = nowMicros() - h.timestamp
+
+	switch h.typ {
+	case stState:
+		if c.ackNr == 0 {
+			// First STATE packet we see is the SYN-ACK: it announces
+			// the peer's send cursor (the seqNr its first real data
+			// packet will use), not a seqNr it has already consumed,
+			// so our ackNr baseline sits one below it.
+			c.ackNr = h.seqNr - 1
+			select {
+			case <-c.synAcked:
+			default:
+				close(c.synAcked)
+			}
+		}
+		c.handleAck(h, now)
+
+	case stData:
+		// Duplicates and retransmits of data we've already drained
+		// past ackNr would otherwise sit in recvBuf forever, since
+		// drainInOrder only ever looks up ackNr+1, ackNr+2, ...
+		if h.seqNr > c.ackNr {
+			c.recvBuf[h.seqNr] = payload
+		}
+		c.drainInOrder()
+		c.sendState()
+
+	case stFin:
+		c.recvBuf[h.seqNr] = nil
+		c.peerClosed = true
+		c.drainInOrder()
+		c.sendState()
+		c.readCond.Broadcast()
+
+	case stReset:
+		c.resetRecvd = true
+		c.closed = true
+		c.readCond.Broadcast()
+	}
+}
+
+// drainInOrder moves contiguous, in-order packets from recvBuf into
+// readBuf and wakes any blocked Read.
+func (c *Conn) drainInOrder() {
+	for {
+		data, ok := c.recvBuf[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.recvBuf, c.ackNr+1)
+		c.ackNr++
+		if data != nil {
+			c.readBuf = append(c.readBuf, data...)
+		}
+	}
+	c.readCond.Broadcast()
+}
+
+// sendState must be called with c.mu held.
+func (c *Conn) sendState() {
+	st := header{
+		typ:           stState,
+		ver:           protocolVersion,
+		connID:        c.connIDSend,
+		seqNr:         c.seqNr,
+		ackNr:         c.ackNr,
+		wndSize:       recvWindow,
+		timestamp:     nowMicros(),
+		timestampDiff: c.replyMicro,
+	}
+	c.pc.WriteTo(st.encode(), c.remoteAddr)
+}
+
+// handleAck retires acked packets from sendQueue and feeds the
+// congestion controller a fresh delay sample. Must be called with
+// c.mu held.
+func (c *Conn) handleAck(h header, now time.Time) {
+	ackedAny := false
+
+	// h.timestampDiff is the peer's own measurement of how long our
+	// packets are taking to reach it - a genuine one-way delay sample,
+	// per BEP-29's timestamp exchange - not something we can derive
+	// from round-trip time, which would also bake in queuing on the
+	// ack's return path that has nothing to do with our send rate. A
+	// zero value means the peer hadn't received anything from us yet
+	// when it sent this ack, so there's no sample to use.
+	delaySample := time.Duration(h.timestampDiff) * time.Microsecond
+
+	for _, p := range c.sendQueue {
+		if p.acked || p.seqNr > h.ackNr {
+			continue
+		}
+		p.acked = true
+		ackedAny = true
+		c.rto = c.cc.updateRTT(now.Sub(p.sentAt))
+		if h.timestampDiff != 0 {
+			c.cc.onAck(delaySample, len(p.data), now)
+		}
+	}
+
+	if ackedAny {
+		c.dupAcks = 0
+	} else {
+		c.dupAcks++
+		if c.dupAcks >= maxDupAcks {
+			c.cc.onDataLoss()
+			c.retransmitOldest(now)
+			c.dupAcks = 0
+		}
+	}
+
+	kept := c.sendQueue[:0]
+	for _, p := range c.sendQueue {
+		if !p.acked {
+			kept = append(kept, p)
+		}
+	}
+	c.sendQueue = kept
+	c.scheduleRTOLocked()
+	c.readCond.Broadcast()
+}
+
+// retransmitOldest must be called with c.mu held.
+func (c *Conn) retransmitOldest(now time.Time) {
+	if len(c.sendQueue) == 0 {
+		return
+	}
+	p := c.sendQueue[0]
+	h := header{
+		typ:           stData,
+		ver:           protocolVersion,
+		connID:        c.connIDSend,
+		seqNr:         p.seqNr,
+		ackNr:         c.ackNr,
+		wndSize:       recvWindow,
+		timestamp:     nowMicros(),
+		timestampDiff: c.replyMicro,
+	}
+	c.pc.WriteTo(append(h.encode(), p.data...), c.remoteAddr)
+	p.sentAt = now
+}
+
+// scheduleRTOLocked (re)arms rtoTimer to fire rtoExpired once rto has
+// elapsed since the oldest unacked packet was sent, so a write that
+// the peer never acks at all - not even a duplicate ack, e.g. because
+// it's waiting on this data before sending anything back - still gets
+// retransmitted instead of stalling the connection forever. Must be
+// called with c.mu held.
+func (c *Conn) scheduleRTOLocked() {
+	if c.rtoTimer != nil {
+		c.rtoTimer.Stop()
+		c.rtoTimer = nil
+	}
+	if c.closed || len(c.sendQueue) == 0 {
+		return
+	}
+	d := c.rto - time.Since(c.sendQueue[0].sentAt)
+	if d < 0 {
+		d = 0
+	}
+	c.rtoTimer = time.AfterFunc(d, c.rtoExpired)
+}
+
+// rtoExpired retransmits the oldest unacked packet and treats its loss
+// as a congestion signal, per BEP-29's RTO-based loss detection.
+func (c *Conn) rtoExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || len(c.sendQueue) == 0 {
+		return
+	}
+	now := time.Now()
+	if d := c.rto - now.Sub(c.sendQueue[0].sentAt); d > 0 {
+		// Spurious wakeup (e.g. a race with a just-processed ack);
+		// reschedule for the time actually remaining.
+		c.rtoTimer = time.AfterFunc(d, c.rtoExpired)
+		return
+	}
+
+	c.cc.onDataLoss()
+	// Exponential backoff on a real RTO, same as TCP: repeated timeouts
+	// mean our current estimate is too optimistic for the path.
+	c.rto *= 2
+	c.retransmitOldest(now)
+	c.scheduleRTOLocked()
+	c.readCond.Broadcast()
+}
+
+// inFlightBytes returns the total size of packets sent but not yet
+// acked. Must be called with c.mu held.
+func (c *Conn) inFlightBytes() int {
+	n := 0
+	for _, p := range c.sendQueue {
+		n += len(p.data)
+	}
+	return n
+}
+
+// availableWindow returns how many more bytes we may have in flight
+// right now: the lesser of our congestion window and the peer's last
+// advertised receive window, minus what's already unacked. Must be
+// called with c.mu held.
+func (c *Conn) availableWindow() int {
+	limit := c.cc.window()
+	if peerWnd := int(c.peerWndSize); peerWnd < limit {
+		limit = peerWnd
+	}
+	avail := limit - c.inFlightBytes()
+	if avail < 0 {
+		avail = 0
+	}
+	return avail
+}
+
+// Read implements net.Conn.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.readBuf) == 0 && !c.closed && !(c.peerClosed && len(c.recvBuf) == 0) {
+		if !c.readDeadline.IsZero() && time.Now().After(c.readDeadline) {
+			return 0, errTimeout{}
+		}
+		c.readCond.Wait()
+	}
+
+	if len(c.readBuf) == 0 {
+		if c.resetRecvd {
+			return 0, ErrReset
+		}
+		if c.closed {
+			return 0, ErrClosed
+		}
+		return 0, io.EOF
+	}
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Write implements net.Conn. Data is chunked into uTP packets sized
+// to fit comfortably under typical path MTUs and handed to the
+// congestion-controlled send queue.
+func (c *Conn) Write(b []byte) (int, error) {
+	const maxPayload = 1400
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, ErrClosed
+	}
+
+	written := 0
+	for len(b) > 0 {
+		for c.availableWindow() <= 0 {
+			if c.closed {
+				return written, ErrClosed
+			}
+			if !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline) {
+				return written, errTimeout{}
+			}
+			c.readCond.Wait()
+		}
+
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		if avail := c.availableWindow(); n > avail {
+			n = avail
+		}
+		chunk := b[:n]
+		b = b[n:]
+
+		seqNr := c.seqNr
+		c.seqNr++
+
+		h := header{
+			typ:           stData,
+			ver:           protocolVersion,
+			connID:        c.connIDSend,
+			seqNr:         seqNr,
+			ackNr:         c.ackNr,
+			wndSize:       recvWindow,
+			timestamp:     nowMicros(),
+			timestampDiff: c.replyMicro,
+		}
+		pkt := &outPacket{seqNr: seqNr, data: append([]byte(nil), chunk...), sentAt: time.Now()}
+		c.sendQueue = append(c.sendQueue, pkt)
+		c.scheduleRTOLocked()
+
+		if _, err := c.pc.WriteTo(append(h.encode(), chunk...), c.remoteAddr); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close implements net.Conn, sending an ST_FIN and releasing the
+// underlying PacketConn if this Conn owns it.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	seqNr := c.seqNr
+	c.seqNr++
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+	}
+	if c.writeTimer != nil {
+		c.writeTimer.Stop()
+	}
+	if c.rtoTimer != nil {
+		c.rtoTimer.Stop()
+	}
+	c.mu.Unlock()
+
+	fin := header{
+		typ:           stFin,
+		ver:           protocolVersion,
+		connID:        c.connIDSend,
+		seqNr:         seqNr,
+		ackNr:         c.ackNr,
+		timestamp:     nowMicros(),
+		timestampDiff: c.replyMicro,
+	}
+	c.pc.WriteTo(fin.encode(), c.remoteAddr)
+
+	c.readCond.Broadcast()
+	return c.teardown()
+}
+
+func (c *Conn) teardown() error {
+	if c.onClose != nil {
+		c.onClose()
+	}
+	if c.owned {
+		return c.pc.Close()
+	}
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (c *Conn) LocalAddr() net.Addr { return c.pc.LocalAddr() }
+
+// RemoteAddr implements net.Conn.
+func (c *Conn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// SetDeadline implements net.Conn.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.armTimerLocked(&c.readTimer, t)
+	c.armTimerLocked(&c.writeTimer, t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.armTimerLocked(&c.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.armTimerLocked(&c.writeTimer, t)
+	return nil
+}
+
+// armTimerLocked (re)arms *timer so it broadcasts readCond once t
+// passes, so a Read or Write blocked in readCond.Wait() with nothing
+// else to wake it still gets re-evaluated against its deadline instead
+// of hanging forever. Must be called with c.mu held.
+func (c *Conn) armTimerLocked(timer **time.Timer, t time.Time) {
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if t.IsZero() {
+		return
+	}
+	d := time.Until(t)
+	*timer = time.AfterFunc(d, func() {
+		c.mu.Lock()
+		c.readCond.Broadcast()
+		c.mu.Unlock()
+	})
+}
+
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "utp: i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
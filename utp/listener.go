@@ -0,0 +1,171 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Listener accepts incoming uTP connections multiplexed over a single
+// shared PacketConn, demultiplexing inbound packets by connection id.
+type Listener struct {
+	pc net.PacketConn
+
+	mu      sync.Mutex
+	conns   map[uint16]*Conn
+	pending chan *Conn
+	closed  bool
+}
+
+// Listen starts listening for uTP connections on laddr.
+func Listen(network, laddr string) (*Listener, error) {
+	pc, err := net.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		pc:      pc,
+		conns:   make(map[uint16]*Conn),
+		pending: make(chan *Conn, 16),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		h, err := decodeHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+
+		l.mu.Lock()
+		c, ok := l.conns[h.connID]
+		if !ok && h.typ == stSyn {
+			// A fresh SYN carries the peer's own recv_id as its
+			// connID (h.connID). Per BEP-29, the peer then addresses
+			// all of its later packets to us with connID+1 instead,
+			// which becomes our recv_id; we address packets back to
+			// the peer with connID unchanged, our send_id.
+			c = newConn(l.pc, addr, h.connID+1, h.connID, false)
+			c.ackNr = h.seqNr
+			c.seqNr = 2
+			c.replyMicro = nowMicros() - h.timestamp
+			recvID := h.connID + 1
+			c.onClose = func() { l.removeConn(recvID) }
+			l.conns[recvID] = c
+
+			st := header{
+				typ:           stState,
+				ver:           protocolVersion,
+				connID:        c.connIDSend,
+				seqNr:         c.seqNr,
+				ackNr:         c.ackNr,
+				wndSize:       recvWindow,
+				timestamp:     nowMicros(),
+				timestampDiff: c.replyMicro,
+			}
+			l.pc.WriteTo(st.encode(), addr)
+
+			select {
+			case l.pending <- c:
+			default:
+				// Backlog full; drop the new connection rather than
+				// block the shared reader goroutine.
+				delete(l.conns, recvID)
+			}
+			l.mu.Unlock()
+			continue
+		}
+		l.mu.Unlock()
+
+		if ok {
+			c.dispatch(pkt)
+		}
+	}
+}
+
+// Dial opens an outbound uTP connection to addr, multiplexed over the
+// same shared PacketConn as l's accepted connections. Unlike
+// DialPacketConn, it hands packets to dispatch via l's own readLoop
+// instead of starting a second reader goroutine that would race it
+// for datagrams off the same socket.
+func (l *Listener) Dial(addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr(l.pc.LocalAddr().Network(), addr)
+	if err != nil {
+		return nil, err
+	}
+
+	connIDRecv := randConnID()
+	c := newConn(l.pc, raddr, connIDRecv, connIDRecv+1, false)
+	c.onClose = func() { l.removeConn(connIDRecv) }
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, errors.New("utp: listener closed")
+	}
+	l.conns[connIDRecv] = c
+	l.mu.Unlock()
+
+	// dialHandshake tears c down on failure, which - via onClose -
+	// also removes it from l.conns, so there's no separate cleanup
+	// needed here.
+	return dialHandshake(c, raddr)
+}
+
+// removeConn removes recvID's entry from l.conns, e.g. once its Conn
+// has closed. Safe to call even if the entry is already gone.
+func (l *Listener) removeConn(recvID uint16) {
+	l.mu.Lock()
+	delete(l.conns, recvID)
+	l.mu.Unlock()
+}
+
+// Accept waits for and returns the next incoming uTP connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, ok := <-l.pending
+	if !ok {
+		return nil, errors.New("utp: listener closed")
+	}
+	return c, nil
+}
+
+// Close stops the listener and its underlying PacketConn.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+	close(l.pending)
+	return l.pc.Close()
+}
+
+// Addr returns the listener's network address.
+func (l *Listener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+func randConnID() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 1
+	}
+	id := binary.BigEndian.Uint16(b[:])
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
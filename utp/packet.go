@@ -0,0 +1,80 @@
+// Package utp implements the Micro Transport Protocol (BEP-29), a
+// reliable, ordered stream transport built on top of UDP that backs
+// off under the LEDBAT congestion controller so it doesn't starve
+// other traffic sharing the link.
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Packet types (4-bit field in the header).
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+// protocolVersion is the only uTP version this package speaks.
+const protocolVersion = 1
+
+// headerLen is the fixed size of a uTP header, in bytes.
+const headerLen = 20
+
+var errShortPacket = errors.New("utp: packet shorter than header")
+
+// header is the 20-byte uTP packet header described by BEP-29.
+type header struct {
+	typ           uint8
+	ver           uint8
+	extension     uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+}
+
+// encode serializes the header into its 20-byte wire form.
+func (h header) encode() []byte {
+	buf := make([]byte, headerLen)
+	buf[0] = (h.typ << 4) | (h.ver & 0x0f)
+	buf[1] = h.extension
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], h.seqNr)
+	binary.BigEndian.PutUint16(buf[18:20], h.ackNr)
+	return buf
+}
+
+// nowMicros returns the current time in microseconds, truncated to
+// uint32 as BEP-29's timestamp fields are: they're only ever compared
+// to each other over short intervals, so wraparound doesn't matter.
+func nowMicros() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// decodeHeader parses a uTP header off the front of buf.
+func decodeHeader(buf []byte) (header, error) {
+	if len(buf) < headerLen {
+		return header{}, errShortPacket
+	}
+	var h header
+	h.typ = buf[0] >> 4
+	h.ver = buf[0] & 0x0f
+	h.extension = buf[1]
+	h.connID = binary.BigEndian.Uint16(buf[2:4])
+	h.timestamp = binary.BigEndian.Uint32(buf[4:8])
+	h.timestampDiff = binary.BigEndian.Uint32(buf[8:12])
+	h.wndSize = binary.BigEndian.Uint32(buf[12:16])
+	h.seqNr = binary.BigEndian.Uint16(buf[16:18])
+	h.ackNr = binary.BigEndian.Uint16(buf[18:20])
+	return h, nil
+}
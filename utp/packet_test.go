@@ -0,0 +1,39 @@
+package utp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHeaderEncodeDecodeRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		h    header
+	}{
+		{"syn", header{typ: stSyn, ver: protocolVersion, connID: 1, seqNr: 1}},
+		{"data", header{typ: stData, ver: protocolVersion, extension: 0, connID: 42, timestamp: 123456, timestampDiff: 789, wndSize: recvWindow, seqNr: 7, ackNr: 6}},
+		{"state", header{typ: stState, ver: protocolVersion, connID: 42, seqNr: 8, ackNr: 7, wndSize: 1500}},
+		{"fin", header{typ: stFin, ver: protocolVersion, connID: 42, seqNr: 99, ackNr: 98}},
+		{"reset", header{typ: stReset, ver: protocolVersion, connID: 42}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := decodeHeader(c.h.encode())
+			if err != nil {
+				t.Fatalf("decodeHeader: %v", err)
+			}
+			if !reflect.DeepEqual(got, c.h) {
+				t.Fatalf("round trip mismatch: got %+v, want %+v", got, c.h)
+			}
+		})
+	}
+}
+
+func TestDecodeHeaderShortPacket(t *testing.T) {
+	for n := 0; n < headerLen; n++ {
+		if _, err := decodeHeader(make([]byte, n)); err != errShortPacket {
+			t.Fatalf("decodeHeader(len %d): got err %v, want errShortPacket", n, err)
+		}
+	}
+}